@@ -14,16 +14,26 @@
 package executor
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"math/rand"
 	"runtime"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/parser/model"
 	"github.com/pingcap/parser/mysql"
 	"github.com/pingcap/tidb/distsql"
 	"github.com/pingcap/tidb/domain"
+	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/metrics"
 	"github.com/pingcap/tidb/sessionctx"
 	"github.com/pingcap/tidb/sessionctx/variable"
@@ -31,19 +41,213 @@ import (
 	"github.com/pingcap/tidb/store/tikv"
 	"github.com/pingcap/tidb/table"
 	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/types"
 	"github.com/pingcap/tidb/util/chunk"
+	"github.com/pingcap/tidb/util/codec"
 	"github.com/pingcap/tidb/util/logutil"
 	"github.com/pingcap/tidb/util/ranger"
 	"github.com/pingcap/tipb/go-tipb"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
 var _ Executor = &AnalyzeExec{}
 
+// AnalyzeTaskKind identifies what an analyze task builds stats for.
+type AnalyzeTaskKind string
+
+// The kinds of analyze task AnalyzeProgressSink can be told about.
+const (
+	AnalyzeTaskColumn AnalyzeTaskKind = "column"
+	AnalyzeTaskIndex  AnalyzeTaskKind = "index"
+	AnalyzeTaskFast   AnalyzeTaskKind = "fast"
+)
+
+// AnalyzeProgressEvent is implemented by every event AnalyzeProgressSink.Emit can receive.
+type AnalyzeProgressEvent interface {
+	isAnalyzeProgressEvent()
+}
+
+// TaskStarted is emitted when a worker picks up a task, alongside the existing job.Start() call.
+type TaskStarted struct {
+	TaskID int
+	Table  string
+	Target string // index or column name; empty for AnalyzeTaskFast, which covers a whole table
+	Kind   AnalyzeTaskKind
+}
+
+// RowsProcessed is emitted every time a task reports progress, alongside the existing
+// job.Update(rowCount) call. EstimatedTotal is 0 when the task has no upfront row estimate.
+type RowsProcessed struct {
+	TaskID         int
+	Delta          int64
+	Cumulative     int64
+	EstimatedTotal int64
+}
+
+// TaskFinished is emitted once a task's result has been handled in AnalyzeExec.Next, alongside the
+// existing job.Finish(...) call.
+type TaskFinished struct {
+	TaskID  int
+	Err     error
+	HistLen int
+	CMSRows int // number of non-nil CM-sketches in the task's result
+}
+
+// PanicRecovered is emitted from analyzeWorker's recover block, alongside the existing
+// metrics.PanicCounter increment.
+type PanicRecovered struct {
+	TaskID int // -1 if no task was in flight when the panic happened
+	Stack  string
+}
+
+func (TaskStarted) isAnalyzeProgressEvent()    {}
+func (RowsProcessed) isAnalyzeProgressEvent()  {}
+func (TaskFinished) isAnalyzeProgressEvent()   {}
+func (PanicRecovered) isAnalyzeProgressEvent() {}
+
+// AnalyzeProgressSink receives structured events over the lifetime of an ANALYZE statement. Emit is
+// called synchronously, from the analyze worker goroutines (TaskStarted, RowsProcessed,
+// PanicRecovered) and from the goroutine running AnalyzeExec.Next (TaskFinished), possibly
+// concurrently, so implementations must be safe for concurrent use and must not block; a sink that
+// needs to do slow I/O should buffer internally.
+type AnalyzeProgressSink interface {
+	Emit(event AnalyzeProgressEvent)
+}
+
+// JSONLinesProgressSink is the default AnalyzeProgressSink: every event is marshaled to one JSON line
+// and written to w (typically a log file opened in append mode), so a tool tailing the file sees
+// progress as it happens without polling the stats-history table.
+type JSONLinesProgressSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLinesProgressSink wraps w as an AnalyzeProgressSink.
+func NewJSONLinesProgressSink(w io.Writer) *JSONLinesProgressSink {
+	return &JSONLinesProgressSink{w: w}
+}
+
+// Emit implements AnalyzeProgressSink.
+func (s *JSONLinesProgressSink) Emit(event AnalyzeProgressEvent) {
+	// TaskFinished.Err is an error interface, which encoding/json marshals as `{}` with no indication
+	// of what went wrong; substitute its message so the failure reason actually reaches the log line.
+	var payload interface{} = event
+	if tf, ok := event.(TaskFinished); ok {
+		var errMsg string
+		if tf.Err != nil {
+			errMsg = tf.Err.Error()
+		}
+		payload = struct {
+			TaskID  int    `json:"TaskID"`
+			Err     string `json:"Err,omitempty"`
+			HistLen int    `json:"HistLen"`
+			CMSRows int    `json:"CMSRows"`
+		}{tf.TaskID, errMsg, tf.HistLen, tf.CMSRows}
+	}
+	line, err := json.Marshal(struct {
+		Type  string      `json:"type"`
+		Event interface{} `json:"event"`
+	}{Type: fmt.Sprintf("%T", event), Event: payload})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = s.w.Write(line)
+}
+
+// PrometheusProgressSink records task durations and rows-sampled counts as Prometheus collectors
+// instead of logging one line per event.
+type PrometheusProgressSink struct {
+	mu        sync.Mutex
+	startedAt map[int]time.Time
+	tables    map[int]string
+	kinds     map[int]AnalyzeTaskKind
+	duration  *prometheus.HistogramVec
+	rows      *prometheus.CounterVec
+}
+
+// NewPrometheusProgressSink builds a PrometheusProgressSink and registers its collectors with reg.
+func NewPrometheusProgressSink(reg prometheus.Registerer) *PrometheusProgressSink {
+	s := &PrometheusProgressSink{
+		startedAt: make(map[int]time.Time),
+		tables:    make(map[int]string),
+		kinds:     make(map[int]AnalyzeTaskKind),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "tidb",
+			Subsystem: "analyze",
+			Name:      "task_duration_seconds",
+			Help:      "Bucketed histogram of ANALYZE task durations.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 20),
+		}, []string{"kind"}),
+		rows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "analyze",
+			Name:      "rows_sampled_total",
+			Help:      "Total rows sampled by ANALYZE, labeled by table.",
+		}, []string{"table"}),
+	}
+	reg.MustRegister(s.duration, s.rows)
+	return s
+}
+
+// Emit implements AnalyzeProgressSink.
+func (s *PrometheusProgressSink) Emit(event AnalyzeProgressEvent) {
+	switch ev := event.(type) {
+	case TaskStarted:
+		s.mu.Lock()
+		s.startedAt[ev.TaskID] = time.Now()
+		s.tables[ev.TaskID] = ev.Table
+		s.kinds[ev.TaskID] = ev.Kind
+		s.mu.Unlock()
+	case RowsProcessed:
+		s.mu.Lock()
+		table := s.tables[ev.TaskID]
+		s.mu.Unlock()
+		s.rows.WithLabelValues(table).Add(float64(ev.Delta))
+	case TaskFinished:
+		s.mu.Lock()
+		start, ok := s.startedAt[ev.TaskID]
+		kind := s.kinds[ev.TaskID]
+		delete(s.startedAt, ev.TaskID)
+		delete(s.tables, ev.TaskID)
+		delete(s.kinds, ev.TaskID)
+		s.mu.Unlock()
+		if ok {
+			if kind == "" {
+				kind = "task"
+			}
+			s.duration.WithLabelValues(string(kind)).Observe(time.Since(start).Seconds())
+		}
+	case PanicRecovered:
+		s.mu.Lock()
+		delete(s.startedAt, ev.TaskID)
+		delete(s.tables, ev.TaskID)
+		delete(s.kinds, ev.TaskID)
+		s.mu.Unlock()
+	}
+}
+
 // AnalyzeExec represents Analyze executor.
 type AnalyzeExec struct {
 	baseExecutor
 	tasks []*analyzeTask
+	// progress receives structured events as tasks run; nil (the default) disables emission entirely.
+	progress AnalyzeProgressSink
+}
+
+// SetProgressSink installs sink as the executor's progress sink. It must be called before Next; pass
+// nil to disable event emission.
+func (e *AnalyzeExec) SetProgressSink(sink AnalyzeProgressSink) {
+	e.progress = sink
+}
+
+func (e *AnalyzeExec) emit(event AnalyzeProgressEvent) {
+	if e.progress != nil {
+		e.progress.Emit(event)
+	}
 }
 
 const (
@@ -63,9 +267,10 @@ func (e *AnalyzeExec) Next(ctx context.Context, req *chunk.RecordBatch) error {
 	taskCh := make(chan *analyzeTask, len(e.tasks))
 	resultCh := make(chan analyzeResult, len(e.tasks))
 	for i := 0; i < concurrency; i++ {
-		go e.analyzeWorker(taskCh, resultCh)
+		go e.analyzeWorker(ctx, taskCh, resultCh)
 	}
-	for _, task := range e.tasks {
+	for i, task := range e.tasks {
+		task.taskID = i
 		statistics.AddNewAnalyzeJob(task.job)
 	}
 	for _, task := range e.tasks {
@@ -83,18 +288,23 @@ func (e *AnalyzeExec) Next(ctx context.Context, req *chunk.RecordBatch) error {
 				logutil.Logger(ctx).Error("analyze failed", zap.Error(err))
 			}
 			result.job.Finish(true)
+			e.emit(TaskFinished{TaskID: result.taskID, Err: result.Err})
 			continue
 		}
+		version := uint64(1)
+		var saveErr error
 		for i, hg := range result.Hist {
-			err1 := statsHandle.SaveStatsToStorage(result.PhysicalTableID, result.Count, result.IsIndex, hg, result.Cms[i], 1)
+			err1 := statsHandle.SaveStatsToStorage(result.PhysicalTableID, result.Count, result.IsIndex, hg, result.Cms[i], version)
 			if err1 != nil {
 				err = err1
+				saveErr = err1
 				logutil.Logger(ctx).Error("save stats to storage failed", zap.Error(err))
 				result.job.Finish(true)
 				continue
 			}
 		}
 		result.job.Finish(false)
+		e.emit(TaskFinished{TaskID: result.taskID, Err: saveErr, HistLen: len(result.Hist), CMSRows: cmsRowCount(result.Cms)})
 	}
 	for _, task := range e.tasks {
 		statistics.MoveToHistory(task.job)
@@ -129,11 +339,45 @@ type analyzeTask struct {
 	colExec  *AnalyzeColumnsExec
 	fastExec *AnalyzeFastExec
 	job      *statistics.AnalyzeJob
+	taskID   int
+}
+
+// describeTask reports the table/target/kind a task analyzes, for TaskStarted. AnalyzeColumnsExec
+// does not carry its table's name, so colTask reports the leading column/PK name as Target and
+// leaves Table blank rather than guessing.
+func describeTask(task *analyzeTask) (table, target string, kind AnalyzeTaskKind) {
+	switch task.taskType {
+	case idxTask:
+		return task.idxExec.idxInfo.Table.O, task.idxExec.idxInfo.Name.O, AnalyzeTaskIndex
+	case colTask:
+		if task.colExec.pkInfo != nil {
+			return "", task.colExec.pkInfo.Name.O, AnalyzeTaskColumn
+		}
+		if len(task.colExec.colsInfo) > 0 {
+			return "", task.colExec.colsInfo[0].Name.O, AnalyzeTaskColumn
+		}
+		return "", "", AnalyzeTaskColumn
+	case fastTask:
+		return task.fastExec.table.Meta().Name.O, "", AnalyzeTaskFast
+	}
+	return "", "", ""
+}
+
+// cmsRowCount counts the non-nil CM-sketches in cmss, used for TaskFinished.CMSRows.
+func cmsRowCount(cmss []*statistics.CMSketch) int {
+	n := 0
+	for _, cms := range cmss {
+		if cms != nil {
+			n++
+		}
+	}
+	return n
 }
 
 var errAnalyzeWorkerPanic = errors.New("analyze worker panic")
 
-func (e *AnalyzeExec) analyzeWorker(taskCh <-chan *analyzeTask, resultCh chan<- analyzeResult) {
+func (e *AnalyzeExec) analyzeWorker(ctx context.Context, taskCh <-chan *analyzeTask, resultCh chan<- analyzeResult) {
+	var current *analyzeTask
 	defer func() {
 		if r := recover(); r != nil {
 			buf := make([]byte, 4096)
@@ -141,23 +385,40 @@ func (e *AnalyzeExec) analyzeWorker(taskCh <-chan *analyzeTask, resultCh chan<-
 			buf = buf[:stackSize]
 			logutil.Logger(context.Background()).Error("analyze worker panicked", zap.String("stack", string(buf)))
 			metrics.PanicCounter.WithLabelValues(metrics.LabelAnalyze).Inc()
+			taskID := -1
+			if current != nil {
+				taskID = current.taskID
+			}
+			e.emit(PanicRecovered{TaskID: taskID, Stack: string(buf)})
 			resultCh <- analyzeResult{
-				Err: errAnalyzeWorkerPanic,
+				Err:    errAnalyzeWorkerPanic,
+				taskID: taskID,
 			}
 		}
 	}()
 	for task := range taskCh {
+		current = task
+		table, target, kind := describeTask(task)
+		e.emit(TaskStarted{TaskID: task.taskID, Table: table, Target: target, Kind: kind})
 		switch task.taskType {
 		case colTask:
 			task.colExec.job = task.job
+			task.colExec.progress = e.progress
+			task.colExec.taskID = task.taskID
 			task.job.Start()
 			resultCh <- analyzeColumnsPushdown(task.colExec)
 		case idxTask:
 			task.idxExec.job = task.job
+			task.idxExec.progress = e.progress
+			task.idxExec.taskID = task.taskID
 			task.job.Start()
 			resultCh <- analyzeIndexPushdown(task.idxExec)
 		case fastTask:
-			for _, result := range analyzeFastExec(task.fastExec) {
+			task.fastExec.job = task.job
+			task.fastExec.progress = e.progress
+			task.fastExec.taskID = task.taskID
+			task.job.Start()
+			for _, result := range analyzeFastExec(ctx, task.fastExec) {
 				resultCh <- result
 			}
 		}
@@ -175,6 +436,7 @@ func analyzeIndexPushdown(idxExec *AnalyzeIndexExec) analyzeResult {
 		Cms:             []*statistics.CMSketch{cms},
 		IsIndex:         1,
 		job:             idxExec.job,
+		taskID:          idxExec.taskID,
 	}
 	result.Count = hist.NullCount
 	if hist.Len() > 0 {
@@ -195,6 +457,10 @@ type AnalyzeIndexExec struct {
 	countNullRes    distsql.SelectResult
 	maxNumBuckets   uint64
 	job             *statistics.AnalyzeJob
+	// progress and taskID are set by analyzeWorker before buildStats runs, so progress updates can be
+	// attributed to this task without threading AnalyzeExec itself through.
+	progress AnalyzeProgressSink
+	taskID   int
 }
 
 // fetchAnalyzeResult builds and dispatches the `kv.Request` from given ranges, and stores the `SelectResult`
@@ -254,6 +520,7 @@ func (e *AnalyzeIndexExec) buildStatsFromResult(result distsql.SelectResult, nee
 	if needCMS {
 		cms = statistics.NewCMSketch(defaultCMSketchDepth, defaultCMSketchWidth)
 	}
+	var cumulative int64
 	for {
 		data, err := result.NextRaw(context.TODO())
 		if err != nil {
@@ -268,7 +535,12 @@ func (e *AnalyzeIndexExec) buildStatsFromResult(result distsql.SelectResult, nee
 			return nil, nil, err
 		}
 		respHist := statistics.HistogramFromProto(resp.Hist)
-		e.job.Update(int64(respHist.TotalRowCount()))
+		delta := int64(respHist.TotalRowCount())
+		cumulative += delta
+		e.job.Update(delta)
+		if e.progress != nil {
+			e.progress.Emit(RowsProcessed{TaskID: e.taskID, Delta: delta, Cumulative: cumulative})
+		}
 		hist, err = statistics.MergeHistograms(e.ctx.GetSessionVars().StmtCtx, hist, respHist, int(e.maxNumBuckets))
 		if err != nil {
 			return nil, nil, err
@@ -320,6 +592,7 @@ func analyzeColumnsPushdown(colExec *AnalyzeColumnsExec) analyzeResult {
 		Hist:            hists,
 		Cms:             cms,
 		job:             colExec.job,
+		taskID:          colExec.taskID,
 	}
 	hist := hists[0]
 	result.Count = hist.NullCount
@@ -341,6 +614,10 @@ type AnalyzeColumnsExec struct {
 	resultHandler   *tableResultHandler
 	maxNumBuckets   uint64
 	job             *statistics.AnalyzeJob
+	// progress and taskID are set by analyzeWorker before buildStats runs, so progress updates can be
+	// attributed to this task without threading AnalyzeExec itself through.
+	progress AnalyzeProgressSink
+	taskID   int
 }
 
 func (e *AnalyzeColumnsExec) open() error {
@@ -403,6 +680,7 @@ func (e *AnalyzeColumnsExec) buildStats() (hists []*statistics.Histogram, cms []
 		}
 	}()
 	pkHist := &statistics.Histogram{}
+	var cumulative int64
 	collectors := make([]*statistics.SampleCollector, len(e.colsInfo))
 	for i := range collectors {
 		collectors[i] = &statistics.SampleCollector{
@@ -440,7 +718,11 @@ func (e *AnalyzeColumnsExec) buildStats() (hists []*statistics.Histogram, cms []
 			rowCount = respSample.Count + respSample.NullCount
 			collectors[i].MergeSampleCollector(sc, respSample)
 		}
+		cumulative += rowCount
 		e.job.Update(rowCount)
+		if e.progress != nil {
+			e.progress.Emit(RowsProcessed{TaskID: e.taskID, Delta: rowCount, Cumulative: cumulative})
+		}
 	}
 	timeZone := e.ctx.GetSessionVars().Location()
 	if e.pkInfo != nil {
@@ -470,10 +752,10 @@ func (e *AnalyzeColumnsExec) buildStats() (hists []*statistics.Histogram, cms []
 	return hists, cms, nil
 }
 
-func analyzeFastExec(exec *AnalyzeFastExec) []analyzeResult {
-	hists, cms, err := exec.buildStats()
+func analyzeFastExec(ctx context.Context, exec *AnalyzeFastExec) []analyzeResult {
+	hists, cms, err := exec.buildStats(ctx)
 	if err != nil {
-		return []analyzeResult{{Err: err}}
+		return []analyzeResult{{Err: err, job: exec.job, taskID: exec.taskID}}
 	}
 	var results []analyzeResult
 	hasIdxInfo := len(exec.idxsInfo)
@@ -489,6 +771,8 @@ func analyzeFastExec(exec *AnalyzeFastExec) []analyzeResult {
 				Cms:             []*statistics.CMSketch{cms[i]},
 				IsIndex:         1,
 				Count:           hists[i].NullCount,
+				job:             exec.job,
+				taskID:          exec.taskID,
 			}
 			if hists[i].Len() > 0 {
 				idxResult.Count += hists[i].Buckets[hists[i].Len()-1].Count
@@ -502,6 +786,8 @@ func analyzeFastExec(exec *AnalyzeFastExec) []analyzeResult {
 		Hist:            hists[:hasPKInfo+len(exec.colsInfo)],
 		Cms:             cms[:hasPKInfo+len(exec.colsInfo)],
 		Count:           hist.NullCount,
+		job:             exec.job,
+		taskID:          exec.taskID,
 	}
 	if hist.Len() > 0 {
 		colResult.Count += hist.Buckets[hist.Len()-1].Count
@@ -534,11 +820,465 @@ type AnalyzeFastExec struct {
 	sampLocRowCount uint64
 	tasks           chan *AnalyzeFastTask
 	scanTasks       []*tikv.KeyLocation
+	job             *statistics.AnalyzeJob
+	// progress and taskID are set by analyzeWorker before buildStats runs, so progress updates can be
+	// attributed to this task without threading AnalyzeExec itself through.
+	progress AnalyzeProgressSink
+	taskID   int
 }
 
-func (e *AnalyzeFastExec) buildStats() (hists []*statistics.Histogram, cms []*statistics.CMSketch, err error) {
-	// TODO: do fast analyze.
-	return nil, nil, nil
+// fastAnalyzeRegionProbeCap bounds how many keys buildSampTasks reads per region while estimating
+// its row count. A region whose key range is exhausted before the cap got an exact count and, if
+// small enough, is cheaper to scan in full than to sample; a region that hits the cap has its row
+// count extrapolated from how much of its key range the probed keys spanned (estimateRegionRowCount).
+const fastAnalyzeRegionProbeCap = 256
+
+// fastSampleRow is a single row collected by the sampling workers, decoded just enough (handle) to
+// feed the PK collector, with the raw row value kept for later column/index decoding.
+type fastSampleRow struct {
+	handle int64
+	value  []byte
+}
+
+// buildSampTasks enumerates the regions covering the table's key range, estimates each one's row
+// count by extrapolating from a bounded key scan, and allocates a sampling budget of maxSampleSize
+// across them via stratified proportional allocation. Regions too small for the estimate to be useful
+// are scanned in full instead (e.scanTasks); the rest become AnalyzeFastTasks on e.tasks for
+// random-key sampling.
+func (e *AnalyzeFastExec) buildSampTasks(ctx context.Context) error {
+	startKey, endKey := tablecodec.GetTableHandleKeyRange(e.PhysicalTableID)
+	txn, err := e.ctx.Txn(true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	bo := tikv.NewBackofferWithVars(context.Background(), 500, nil)
+
+	var locs []*tikv.KeyLocation
+	for key := startKey; len(key) == 0 || bytes.Compare(key, endKey) < 0; {
+		loc, err1 := e.cache.LocateKey(bo, key)
+		if err1 != nil {
+			return errors.Trace(err1)
+		}
+		locs = append(locs, loc)
+		if len(loc.EndKey) == 0 || bytes.Compare(loc.EndKey, endKey) >= 0 {
+			break
+		}
+		key = loc.EndKey
+	}
+
+	type regionEstimate struct {
+		loc      *tikv.KeyLocation
+		rowCount uint64
+		exact    bool
+	}
+	estimates := make([]regionEstimate, len(locs))
+	locIdxCh := make(chan int, len(locs))
+	for i := range locs {
+		locIdxCh <- i
+	}
+	close(locIdxCh)
+
+	// txn's snapshot iterator isn't safe for concurrent use, so the worker goroutines below share one
+	// mutex around the only part that touches txn; everything else (region math, estimates[idx] writes
+	// to disjoint slots) still runs concurrently.
+	var txnMu sync.Mutex
+	e.wg = &sync.WaitGroup{}
+	e.wg.Add(e.concurrency)
+	for i := 0; i < e.concurrency; i++ {
+		go func() {
+			defer e.wg.Done()
+			for idx := range locIdxCh {
+				if ctx.Err() != nil {
+					continue
+				}
+				loc := locs[idx]
+				upper := loc.EndKey
+				if len(upper) == 0 || bytes.Compare(upper, endKey) > 0 {
+					upper = endKey
+				}
+				rowCount, exact := func() (uint64, bool) {
+					txnMu.Lock()
+					defer txnMu.Unlock()
+					it, err1 := txn.Iter(loc.StartKey, upper)
+					if err1 != nil {
+						return 0, false
+					}
+					defer it.Close()
+					var n uint64
+					var lastKey []byte
+					for it.Valid() && n < fastAnalyzeRegionProbeCap {
+						n++
+						lastKey = it.Key()
+						if it.Next() != nil {
+							break
+						}
+					}
+					if !it.Valid() {
+						return n, true
+					}
+					// The probe hit the cap with the region still unexhausted: extrapolate the full
+					// region row count from how much of the region's key range those n rows spanned,
+					// instead of reporting the cap itself (which would make every region bigger than
+					// the cap look identically sized to proportional allocation below).
+					return estimateRegionRowCount(loc.StartKey, upper, lastKey, n), false
+				}()
+				estimates[idx] = regionEstimate{loc: loc, rowCount: rowCount, exact: exact}
+			}
+		}()
+	}
+	e.wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return errors.Trace(err)
+	}
+
+	var totalWeight uint64
+	for _, est := range estimates {
+		totalWeight += est.rowCount
+	}
+	e.sampLocRowCount = totalWeight
+
+	e.tasks = make(chan *AnalyzeFastTask, len(estimates))
+	for _, est := range estimates {
+		if est.rowCount == 0 {
+			continue
+		}
+		if est.exact && est.rowCount <= fastAnalyzeRegionProbeCap/4 {
+			e.scanTasks = append(e.scanTasks, est.loc)
+			continue
+		}
+		sampSize := uint64(maxSampleSize)
+		if totalWeight > 0 {
+			sampSize = uint64(maxSampleSize) * est.rowCount / totalWeight
+		}
+		if sampSize == 0 {
+			sampSize = 1
+		}
+		e.tasks <- &AnalyzeFastTask{Location: est.loc, SampSize: sampSize, LRowCount: est.rowCount}
+	}
+	close(e.tasks)
+	return nil
+}
+
+// estimateRegionRowCount extrapolates a region's full row count from a bounded probe: probed covered
+// only the fraction of [start, upper) up to lastKey, so scaling probed by the inverse of that fraction
+// estimates the rest. Falls back to the raw probe count if the fraction can't be computed meaningfully.
+func estimateRegionRowCount(start, upper, lastKey []byte, probed uint64) uint64 {
+	fraction := keyFraction(start, upper, lastKey)
+	if fraction <= 0 {
+		return probed
+	}
+	total := float64(probed) / fraction
+	if total < float64(probed) {
+		return probed
+	}
+	return uint64(total)
+}
+
+// keyFraction estimates how far key lies between lo (inclusive) and hi (exclusive), as a value in
+// [0, 1), by comparing the keys as big-endian integers of equal length (shorter keys zero-padded on
+// the right to match). It returns 0 when hi does not lie above lo. This is only used to weight regions by probe density, not to address individual
+// rows, so the approximation doesn't need to be exact.
+func keyFraction(lo, hi, key []byte) float64 {
+	n := len(hi)
+	if len(lo) > n {
+		n = len(lo)
+	}
+	if len(key) > n {
+		n = len(key)
+	}
+	pad := func(b []byte) *big.Int {
+		buf := make([]byte, n)
+		copy(buf, b)
+		return new(big.Int).SetBytes(buf)
+	}
+	loInt, hiInt, keyInt := pad(lo), pad(hi), pad(key)
+	span := new(big.Int).Sub(hiInt, loInt)
+	if span.Sign() <= 0 {
+		return 0
+	}
+	offset := new(big.Int).Sub(keyInt, loInt)
+	f := new(big.Float).Quo(new(big.Float).SetInt(offset), new(big.Float).SetInt(span))
+	out, _ := f.Float64()
+	return out
+}
+
+// randomKeyInRange picks an approximately uniform random key in [start, end) by decoding both bounds
+// as row-key handles and picking a random handle between them — the handle is the only part of a row
+// key that varies within a table, so this actually ranges over the region, unlike appending a random
+// suffix to start. Falls back to randomKeyByInterpolation when a bound doesn't decode as a row key,
+// which only happens at the first/last region of the whole keyspace.
+func (e *AnalyzeFastExec) randomKeyInRange(start, end []byte) kv.Key {
+	if len(end) != 0 && bytes.Compare(start, end) >= 0 {
+		return kv.Key(start)
+	}
+	lo, errLo := tablecodec.DecodeRowKey(start)
+	hasHi := len(end) != 0
+	hi := int64(math.MaxInt64)
+	errHi := error(nil)
+	if hasHi {
+		hi, errHi = tablecodec.DecodeRowKey(end)
+	}
+	if errLo == nil && errHi == nil && hi > lo {
+		span := uint64(hi) - uint64(lo)
+		handle := int64(uint64(lo) + rand.Uint64()%span)
+		return tablecodec.EncodeRowKeyWithHandle(e.PhysicalTableID, handle)
+	}
+	return randomKeyByInterpolation(start, end)
+}
+
+// randomKeyByInterpolation picks a key in [start, end) by appending 8 random bytes to start, trying up
+// to 8 times for a result that compares below end and returning start itself if none does (or if end
+// is empty). Every key it returns has start as a prefix, so the keys are not spread over the whole
+// range. Used only as randomKeyInRange's fallback, where start/end aren't row-key handles to decode.
+func randomKeyByInterpolation(start, end []byte) kv.Key {
+	if len(end) == 0 {
+		return kv.Key(start)
+	}
+	for attempt := 0; attempt < 8; attempt++ {
+		buf := append(append([]byte(nil), start...), 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(start):], rand.Uint64())
+		if bytes.Compare(buf, end) < 0 {
+			return kv.Key(buf)
+		}
+	}
+	return kv.Key(start)
+}
+
+// sampleTask performs task.SampSize bounded random-key point scans inside task.Location and sends
+// whatever row each lands on to rowCh. txnMu must be held for every call into txn: a single
+// kv.Transaction's snapshot iterator is not safe for concurrent use, and sampleTask is called from
+// e.concurrency worker goroutines sharing the same txn.
+func (e *AnalyzeFastExec) sampleTask(ctx context.Context, txnMu *sync.Mutex, txn kv.Transaction, task *AnalyzeFastTask, rowCh chan<- fastSampleRow) error {
+	for i := uint64(0); i < task.SampSize; i++ {
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+		row, ok, err := func() (fastSampleRow, bool, error) {
+			txnMu.Lock()
+			defer txnMu.Unlock()
+			it, err := txn.Iter(e.randomKeyInRange(task.Location.StartKey, task.Location.EndKey), task.Location.EndKey)
+			if err != nil {
+				return fastSampleRow{}, false, errors.Trace(err)
+			}
+			defer it.Close()
+			if !it.Valid() {
+				return fastSampleRow{}, false, nil
+			}
+			handle, err1 := tablecodec.DecodeRowKey(it.Key())
+			if err1 != nil {
+				return fastSampleRow{}, false, nil
+			}
+			return fastSampleRow{handle: handle, value: append([]byte(nil), it.Value()...)}, true, nil
+		}()
+		if err != nil {
+			return err
+		}
+		if ok {
+			rowCh <- row
+		}
+	}
+	return nil
+}
+
+// scanRegion reads a full region in order, bounded by maxRegionSampleSize, for regions buildSampTasks
+// decided were too small to benefit from random-key sampling. txnMu guards txn the same way it does
+// in sampleTask.
+func (e *AnalyzeFastExec) scanRegion(ctx context.Context, txnMu *sync.Mutex, txn kv.Transaction, loc *tikv.KeyLocation, rowCh chan<- fastSampleRow) error {
+	txnMu.Lock()
+	defer txnMu.Unlock()
+	it, err := txn.Iter(loc.StartKey, loc.EndKey)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer it.Close()
+	for n := 0; it.Valid() && n < maxRegionSampleSize; n++ {
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+		if handle, err1 := tablecodec.DecodeRowKey(it.Key()); err1 == nil {
+			rowCh <- fastSampleRow{handle: handle, value: append([]byte(nil), it.Value()...)}
+		}
+		if err1 := it.Next(); err1 != nil {
+			return errors.Trace(err1)
+		}
+	}
+	return nil
+}
+
+// runSampTasks drains e.tasks with a concurrency-worker pool and then e.scanTasks, feeding every
+// sampled row into rowCh. rowCh is closed by the caller once this returns. All workers share a single
+// txn, so a mutex serializes access to it; only the other, per-row work (random key generation, row
+// decode, channel send) actually runs concurrently.
+func (e *AnalyzeFastExec) runSampTasks(ctx context.Context, txn kv.Transaction, rowCh chan<- fastSampleRow) error {
+	var wg sync.WaitGroup
+	var txnMu sync.Mutex
+	errCh := make(chan error, e.concurrency+len(e.scanTasks))
+	wg.Add(e.concurrency)
+	for i := 0; i < e.concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for task := range e.tasks {
+				if err := e.sampleTask(ctx, &txnMu, txn, task, rowCh); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		close(errCh)
+		return errors.Trace(err)
+	}
+	for _, loc := range e.scanTasks {
+		if err := e.scanRegion(ctx, &txnMu, txn, loc, rowCh); err != nil {
+			errCh <- err
+		}
+	}
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newFastSampleCollector builds an empty SampleCollector in the same shape AnalyzeColumnsExec.buildStats
+// uses, so BuildColumn produces histograms/CM-sketches consistent with the pushdown path.
+func newFastSampleCollector() *statistics.SampleCollector {
+	return &statistics.SampleCollector{
+		IsMerger:      true,
+		FMSketch:      statistics.NewFMSketch(maxSketchSize),
+		MaxSampleSize: maxSampleSize,
+		CMSketch:      statistics.NewCMSketch(defaultCMSketchDepth, defaultCMSketchWidth),
+	}
+}
+
+// buildStats drives fast analyze end-to-end: it builds a region-proportional sample plan via
+// buildSampTasks, collects the sampled rows concurrently via runSampTasks, decodes each row into
+// per-column and per-index SampleCollectors (with FMSketch and CMSketch, as in
+// AnalyzeColumnsExec.buildStats), and finally calls statistics.BuildColumn to produce the same
+// []*statistics.Histogram / []*statistics.CMSketch shape the pushdown path returns, letting
+// analyzeFastExec slice the result as it already does: PK, then columns, then indexes.
+func (e *AnalyzeFastExec) buildStats(ctx context.Context) (hists []*statistics.Histogram, cms []*statistics.CMSketch, err error) {
+	if err = e.buildSampTasks(ctx); err != nil {
+		return nil, nil, err
+	}
+	txn, err := e.ctx.Txn(true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rowCh := make(chan fastSampleRow, maxSampleSize)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- e.runSampTasks(ctx, txn, rowCh)
+		close(rowCh)
+	}()
+
+	var pkCollector *statistics.SampleCollector
+	if e.pkInfo != nil {
+		pkCollector = &statistics.SampleCollector{IsMerger: true, FMSketch: statistics.NewFMSketch(maxSketchSize), MaxSampleSize: maxSampleSize}
+	}
+	colCollectors := make([]*statistics.SampleCollector, len(e.colsInfo))
+	for i := range colCollectors {
+		colCollectors[i] = newFastSampleCollector()
+	}
+	idxCollectors := make([]*statistics.SampleCollector, len(e.idxsInfo))
+	for i := range idxCollectors {
+		idxCollectors[i] = newFastSampleCollector()
+	}
+
+	fieldTypes := make(map[int64]*types.FieldType, len(e.colsInfo))
+	for _, col := range e.colsInfo {
+		fieldTypes[col.ID] = &col.FieldType
+	}
+	tblInfo := e.table.Meta()
+	sc := e.ctx.GetSessionVars().StmtCtx
+	timeZone := e.ctx.GetSessionVars().Location()
+
+	rowCount := int64(0)
+	for row := range rowCh {
+		rowCount++
+		if e.job != nil {
+			// job.Update is additive, like every other path's RowsProcessed.Delta, not a replace-with-
+			// cumulative-total; passing rowCount here would inflate progress as 1+2+3+...
+			e.job.Update(1)
+		}
+		if e.progress != nil {
+			e.progress.Emit(RowsProcessed{TaskID: e.taskID, Delta: 1, Cumulative: rowCount, EstimatedTotal: int64(e.sampLocRowCount)})
+		}
+		if pkCollector != nil {
+			pkCollector.FMSketch.InsertValue(sc, types.NewIntDatum(row.handle))
+		}
+		datums, err1 := tablecodec.DecodeRowToDatumMap(row.value, fieldTypes, timeZone)
+		if err1 != nil {
+			continue
+		}
+		for i, col := range e.colsInfo {
+			d, ok := datums[col.ID]
+			if !ok {
+				d = types.NewDatum(nil)
+			}
+			colCollectors[i].FMSketch.InsertValue(sc, d)
+			if b, err1 := codec.EncodeValue(sc, nil, d); err1 == nil {
+				colCollectors[i].CMSketch.InsertBytes(b)
+			}
+			if len(colCollectors[i].Samples) < maxSampleSize {
+				colCollectors[i].Samples = append(colCollectors[i].Samples, &statistics.SampleItem{Value: d})
+			}
+		}
+		for i, idxInfo := range e.idxsInfo {
+			idxVals := make([]types.Datum, 0, len(idxInfo.Columns))
+			for _, idxCol := range idxInfo.Columns {
+				d, ok := datums[tblInfo.Columns[idxCol.Offset].ID]
+				if !ok {
+					d = types.NewDatum(nil)
+				}
+				idxVals = append(idxVals, d)
+			}
+			b, err1 := codec.EncodeKey(sc, nil, idxVals...)
+			if err1 != nil {
+				continue
+			}
+			idxCollectors[i].FMSketch.InsertValue(sc, types.NewBytesDatum(b))
+			idxCollectors[i].CMSketch.InsertBytes(b)
+			if len(idxCollectors[i].Samples) < maxSampleSize {
+				idxCollectors[i].Samples = append(idxCollectors[i].Samples, &statistics.SampleItem{Value: types.NewBytesDatum(b)})
+			}
+		}
+	}
+	if err1 := <-errCh; err1 != nil {
+		return nil, nil, err1
+	}
+
+	if pkCollector != nil {
+		pkHist, err1 := statistics.BuildColumn(e.ctx, int64(e.maxNumBuckets), e.pkInfo.ID, pkCollector, &e.pkInfo.FieldType)
+		if err1 != nil {
+			return nil, nil, err1
+		}
+		hists = append(hists, pkHist)
+		cms = append(cms, nil)
+	}
+	for i, col := range e.colsInfo {
+		hg, err1 := statistics.BuildColumn(e.ctx, int64(e.maxNumBuckets), col.ID, colCollectors[i], &col.FieldType)
+		if err1 != nil {
+			return nil, nil, err1
+		}
+		hists = append(hists, hg)
+		cms = append(cms, colCollectors[i].CMSketch)
+	}
+	blobType := types.NewFieldType(mysql.TypeBlob)
+	for i, idxInfo := range e.idxsInfo {
+		hg, err1 := statistics.BuildColumn(e.ctx, int64(e.maxNumBuckets), idxInfo.ID, idxCollectors[i], blobType)
+		if err1 != nil {
+			return nil, nil, err1
+		}
+		hists = append(hists, hg)
+		cms = append(cms, idxCollectors[i].CMSketch)
+	}
+	return hists, cms, nil
 }
 
 // analyzeResult is used to represent analyze result.
@@ -551,4 +1291,6 @@ type analyzeResult struct {
 	IsIndex         int
 	Err             error
 	job             *statistics.AnalyzeJob
+	// taskID identifies the analyzeTask this result came from, for AnalyzeProgressSink events.
+	taskID int
 }
@@ -15,6 +15,8 @@ package statistics
 
 import (
 	"bytes"
+	"container/heap"
+	"encoding/binary"
 	"math"
 	"sort"
 
@@ -32,6 +34,87 @@ import (
 // topNThreshold is the minimum ratio of the number of topn elements in CMSketch, 10 means 1 / 10 = 10%.
 const topNThreshold = uint64(10)
 
+// bloomFilter is a small, fixed-size Bloom filter used as an existence pre-filter for CMSketch point
+// queries: a negative answer lets QueryBytes return defaultValue immediately, without paying for
+// depth hash probes and a median computation on a value that is known not to appear.
+type bloomFilter struct {
+	bits    []uint64
+	nBits   uint64
+	nHashes uint32
+}
+
+// newBloomFilter sizes a Bloom filter for n expected items at the given false-positive rate, using
+// the standard m = -n*ln(p)/(ln2)^2 and k = (m/n)*ln2 formulas.
+func newBloomFilter(n uint64, fpRate float64) *bloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	words := (m + 63) / 64
+	return &bloomFilter{bits: make([]uint64, words), nBits: words * 64, nHashes: k}
+}
+
+// add marks d as present. It reuses the same murmur3 h1/h2 pair as the rest of the sketch and
+// derives nHashes probe positions from them via double hashing (Kirsch-Mitzenmacher).
+func (f *bloomFilter) add(d []byte) {
+	h1, h2 := murmur3.Sum128(d)
+	for i := uint32(0); i < f.nHashes; i++ {
+		pos := (h1 + uint64(i)*h2) % f.nBits
+		f.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+// mayContain reports whether d could have been added. A false return is certain; a true return may
+// be a false positive at roughly the rate the filter was sized for.
+func (f *bloomFilter) mayContain(d []byte) bool {
+	h1, h2 := murmur3.Sum128(d)
+	for i := uint32(0); i < f.nHashes; i++ {
+		pos := (h1 + uint64(i)*h2) % f.nBits
+		if f.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// marshal serializes the filter as nHashes (4 bytes), bit count (8 bytes), then the bit words.
+func (f *bloomFilter) marshal() []byte {
+	buf := make([]byte, 12+len(f.bits)*8)
+	binary.LittleEndian.PutUint32(buf[0:4], f.nHashes)
+	binary.LittleEndian.PutUint64(buf[4:12], f.nBits)
+	for i, w := range f.bits {
+		binary.LittleEndian.PutUint64(buf[12+i*8:20+i*8], w)
+	}
+	return buf
+}
+
+// unmarshalBloomFilter is the inverse of bloomFilter.marshal.
+func unmarshalBloomFilter(data []byte) *bloomFilter {
+	if len(data) < 12 {
+		return nil
+	}
+	f := &bloomFilter{
+		nHashes: binary.LittleEndian.Uint32(data[0:4]),
+		nBits:   binary.LittleEndian.Uint64(data[4:12]),
+	}
+	words := (len(data) - 12) / 8
+	f.bits = make([]uint64, words)
+	for i := 0; i < words; i++ {
+		f.bits[i] = binary.LittleEndian.Uint64(data[12+i*8 : 20+i*8])
+	}
+	return f
+}
+
 // CMSketch is used to estimate point queries.
 // Refer: https://en.wikipedia.org/wiki/Count-min_sketch
 type CMSketch struct {
@@ -40,15 +123,23 @@ type CMSketch struct {
 	count        uint64 // TopN is not counted in count
 	defaultValue uint64 // In sampled data, if cmsketch returns a small value (less than avg value / 2), then this will returned.
 	table        [][]uint32
-	topN         map[uint64][]dataCount
+	topN         map[uint64][]*dataCount
+	numTop       uint32   // the Top-N capacity; only set when topN maintenance is active
+	topNHeap     topNHeap // min-heap over the same *dataCount entries stored in topN, used by InsertBytesTopN
+	conservative bool     // conservative update (CM-CU) mode, see updateBytesWithDelta
+	resetEvery   uint64   // automatic Reset trigger period; 0 disables it
+	insertsSeen  uint64   // inserts since the last Reset, only tracked when resetEvery > 0
+	bloom        *bloomFilter // optional existence pre-filter, see WithBloom
+	topNInTable  bool // set once InsertBytesTopN promotes an item; see its doc comment and MergeCMSketch
 }
 
 // dataCount is a simple counter used by BuildTopN
 type dataCount struct {
-	h1    uint64
-	h2    uint64
-	data  []byte
-	count uint64
+	h1      uint64
+	h2      uint64
+	data    []byte
+	count   uint64
+	heapIdx int // position in topNHeap, -1 when the item is not tracked by the heap
 }
 
 // NewCMSketch returns a new CM sketch.
@@ -139,18 +230,17 @@ func (helper *topNHelper) buildCMSWithTopN(d, w int32, ratio uint64) (c *CMSketc
 		return
 	}
 	helper.numTop = uint32(len(topN))
-	c.topN = make(map[uint64][]dataCount)
+	c.numTop = helper.numTop
+	c.topN = make(map[uint64][]*dataCount)
+	c.topNHeap = make(topNHeap, 0, len(topN))
 	for i := range topN {
 		if topN[i].data == nil {
 			continue
 		}
 		h1, h2 := murmur3.Sum128(topN[i].data)
-		vals, ok := c.topN[h1]
-		if !ok {
-			vals = make([]dataCount, 0)
-		}
-		vals = append(vals, dataCount{h1, h2, topN[i].data, topN[i].count})
-		c.topN[h1] = vals
+		item := &dataCount{h1: h1, h2: h2, data: topN[i].data, count: topN[i].count, heapIdx: -1}
+		c.topN[h1] = append(c.topN[h1], item)
+		heap.Push(&c.topNHeap, item)
 	}
 	return
 }
@@ -178,6 +268,9 @@ func (c *CMSketch) updateTopNWithDelta(h1, h2, delta uint64, d []byte) bool {
 	for _, cnt := range c.topN[h1] {
 		if cnt.h2 == h2 && bytes.Equal(d, cnt.data) {
 			cnt.count += delta
+			if cnt.heapIdx >= 0 {
+				heap.Fix(&c.topNHeap, cnt.heapIdx)
+			}
 			return true
 		}
 	}
@@ -203,17 +296,209 @@ func (c *CMSketch) InsertBytes(bytes []byte) {
 
 // insertBytesN adds the bytes value into the CM Sketch by n.
 func (c *CMSketch) updateBytesWithDelta(bytes []byte, n uint64) {
+	if c.bloom != nil {
+		c.bloom.add(bytes)
+	}
 	h1, h2 := murmur3.Sum128(bytes)
 	if c.updateTopNWithDelta(h1, h2, n, bytes) {
 		return
 	}
 	c.count += n
+	if !c.conservative {
+		for i := range c.table {
+			j := (h1 + h2*uint64(i)) % uint64(c.width)
+			c.table[i][j] += uint32(n)
+		}
+	} else {
+		// Conservative update (CM-CU): only raise the counters that are already at the row-minimum
+		// estimate for this key, instead of all of them. This is known to reduce CM overestimation
+		// significantly on skewed streams, at the cost of making the sketch non-mergeable across
+		// differently-ordered inserts.
+		js := make([]uint64, len(c.table))
+		min := uint32(math.MaxUint32)
+		for i := range c.table {
+			j := (h1 + h2*uint64(i)) % uint64(c.width)
+			js[i] = j
+			if c.table[i][j] < min {
+				min = c.table[i][j]
+			}
+		}
+		for i := range c.table {
+			if c.table[i][js[i]] == min {
+				c.table[i][js[i]] += uint32(n)
+			}
+		}
+	}
+	if c.resetEvery == 0 {
+		return
+	}
+	c.insertsSeen++
+	if c.insertsSeen >= c.resetEvery {
+		c.insertsSeen = 0
+		c.Reset()
+	}
+}
+
+// EnableConservativeUpdate switches the sketch to conservative update (CM-CU) mode, where an insert
+// only raises the counters already at the row-minimum for that key. Existing counts are unaffected;
+// this only changes how future inserts are applied.
+func (c *CMSketch) EnableConservativeUpdate() {
+	c.conservative = true
+}
+
+// EnableAutoReset makes the sketch call Reset automatically every interval inserts, so long-lived
+// sketches age out stale heavy hitters without a caller having to drive Reset by hand. Only inserts
+// that reach the CM table are counted: an insert absorbed by an existing Top-N entry does not advance
+// the count.
+func (c *CMSketch) EnableAutoReset(interval uint64) {
+	c.resetEvery = interval
+	c.insertsSeen = 0
+}
+
+// Reset halves every counter in the sketch, a conservative-decay aging pass borrowed from TinyLFU's
+// freshness mechanism. This keeps counters in long-lived sketches from growing unboundedly and lets
+// stale heavy hitters fall out of the Top-N. Counters use unsigned integer division, so halving
+// introduces a small, well-understood underestimation of true frequencies.
+func (c *CMSketch) Reset() {
 	for i := range c.table {
-		j := (h1 + h2*uint64(i)) % uint64(c.width)
-		c.table[i][j] += uint32(n)
+		for j := range c.table[i] {
+			c.table[i][j] >>= 1
+		}
+	}
+	c.count >>= 1
+	c.defaultValue >>= 1
+	if c.topN == nil {
+		return
+	}
+	// Items are evicted from the Top-N once their decayed count falls below the table's current
+	// admission threshold; they are folded back into the CM table so their count is not lost.
+	threshold := c.count / uint64(c.width)
+	var evicted []*dataCount
+	for h1, items := range c.topN {
+		kept := items[:0]
+		for _, item := range items {
+			item.count >>= 1
+			if item.count < threshold {
+				evicted = append(evicted, item)
+				continue
+			}
+			kept = append(kept, item)
+		}
+		if len(kept) == 0 {
+			delete(c.topN, h1)
+		} else {
+			c.topN[h1] = kept
+		}
+	}
+	for _, item := range evicted {
+		if item.heapIdx >= 0 {
+			heap.Remove(&c.topNHeap, item.heapIdx)
+		}
+		c.updateBytesWithDelta(item.data, item.count)
 	}
 }
 
+// topNHeap is a min-heap over *dataCount ordered by count, used to maintain the Top-N set of a
+// CMSketch online: evicting the heap's minimum is how InsertBytesTopN decides what falls out of
+// the Top-N as new, more frequent items arrive.
+type topNHeap []*dataCount
+
+func (h topNHeap) Len() int            { return len(h) }
+func (h topNHeap) Less(i, j int) bool  { return h[i].count < h[j].count }
+func (h topNHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i]; h[i].heapIdx, h[j].heapIdx = i, j }
+func (h *topNHeap) Push(x interface{}) {
+	item := x.(*dataCount)
+	item.heapIdx = len(*h)
+	*h = append(*h, item)
+}
+func (h *topNHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	item.heapIdx = -1
+	*h = old[:n-1]
+	return item
+}
+
+// InsertBytesTopN inserts the bytes value into the CM Sketch and maintains a size-numTop Top-N set
+// backed by topNHeap, without requiring the whole sample to be known up front. On each insert, the
+// CM counters are updated first, then the resulting estimate is compared against the heap's current
+// minimum: if it already tracks the item, or it beats the minimum (or the heap has spare capacity),
+// the item is pushed/updated and the smallest entry is popped back into the CM table. This keeps
+// Top-N maintenance accurate under streaming inserts at O(log numTop) heap work per insert; an insert
+// that is not already tracked still allocates for its CM estimate, and a promotion allocates a new
+// entry and a copy of b.
+//
+// Unlike NewCMSketchWithTopN's batch builder, a promoted item here is NOT excluded from the table:
+// deciding whether to promote needs a CM estimate for the item, which in turn needs the table updated
+// first, so there is no way to keep "TopN is not counted in count" for an online-built sketch without
+// an insert-order-dependent undo of table counters shared with other, possibly colliding, items. The
+// topNInTable flag records this so MergeCMSketch can refuse to combine such a sketch with another one
+// instead of silently double-counting every heavy hitter.
+func (c *CMSketch) InsertBytesTopN(b []byte) {
+	if c.numTop == 0 {
+		c.InsertBytes(b)
+		return
+	}
+	h1, h2 := murmur3.Sum128(b)
+	if c.topN != nil && c.updateTopNWithDelta(h1, h2, 1, b) {
+		// Item already tracked; updateTopNWithDelta above bumped its count and fixed the heap.
+		return
+	}
+	c.updateBytesWithDelta(b, 1)
+	if c.topN == nil {
+		c.topN = make(map[uint64][]*dataCount)
+	}
+	estimate := c.queryHashValue(h1, h2)
+	if uint32(len(c.topNHeap)) < c.numTop {
+		item := &dataCount{h1: h1, h2: h2, data: append([]byte(nil), b...), count: estimate, heapIdx: -1}
+		heap.Push(&c.topNHeap, item)
+		c.topN[h1] = append(c.topN[h1], item)
+		c.topNInTable = true
+		return
+	}
+	if estimate <= c.topNHeap[0].count {
+		return
+	}
+	evicted := heap.Pop(&c.topNHeap).(*dataCount)
+	c.removeFromTopNIndex(evicted)
+	item := &dataCount{h1: h1, h2: h2, data: append([]byte(nil), b...), count: estimate, heapIdx: -1}
+	heap.Push(&c.topNHeap, item)
+	c.topN[h1] = append(c.topN[h1], item)
+	c.topNInTable = true
+}
+
+// removeFromTopNIndex drops an evicted entry from c.topN; its count stays reflected in the CM table
+// because queryHashValue already accounted for it before eviction.
+func (c *CMSketch) removeFromTopNIndex(evicted *dataCount) {
+	vals := c.topN[evicted.h1]
+	for i, v := range vals {
+		if v == evicted {
+			vals = append(vals[:i], vals[i+1:]...)
+			break
+		}
+	}
+	if len(vals) == 0 {
+		delete(c.topN, evicted.h1)
+	} else {
+		c.topN[evicted.h1] = vals
+	}
+}
+
+// TopN returns the current Top-N entries tracked by the sketch, largest first.
+func (c *CMSketch) TopN() []dataCount {
+	items := make([]*dataCount, len(c.topNHeap))
+	copy(items, c.topNHeap)
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].count > items[j].count
+	})
+	res := make([]dataCount, 0, len(items))
+	for _, item := range items {
+		res = append(res, *item)
+	}
+	return res
+}
+
 func (c *CMSketch) considerDefVal(cnt uint64) bool {
 	return cnt < 2*(c.count/uint64(c.width)) && c.defaultValue > 0
 }
@@ -252,6 +537,11 @@ func (c *CMSketch) queryValue(sc *stmtctx.StatementContext, val types.Datum) (ui
 
 // QueryBytes is used to query the count of specified bytes.
 func (c *CMSketch) QueryBytes(d []byte) uint64 {
+	if c.bloom != nil && !c.bloom.mayContain(d) {
+		// Neither in the Top-N nor ever inserted: skip the depth hash probes and median
+		// computation queryHashValue would otherwise do and return the average-item estimate.
+		return c.defaultValue
+	}
 	h1, h2 := murmur3.Sum128(d)
 	if count, ok := c.queryTopN(h1, h2, d); ok {
 		return count
@@ -259,6 +549,33 @@ func (c *CMSketch) QueryBytes(d []byte) uint64 {
 	return c.queryHashValue(h1, h2)
 }
 
+// WithBloom attaches a Bloom filter existence pre-filter to the sketch, sized from its current count
+// at the given false-positive rate, and returns the same sketch for chaining. Once attached,
+// QueryBytes consults it first and returns defaultValue immediately on a negative. The filter can
+// only be backfilled from the sketch's current Top-N set, since individual values already folded into
+// the CM table are not recoverable from it; calling WithBloom on a sketch that already has a non-zero
+// count but no Top-N entries would produce a filter that answers "not present" for every one of those
+// already-aggregated values, turning real point queries into silent false negatives. WithBloom refuses
+// that case and leaves the sketch without a filter instead. Call it as early as possible (right after
+// NewCMSketch/NewCMSketchWithTopN, before further inserts) to get the strongest guarantee. This is a
+// pure additive knob: sketches decoded without a filter behave exactly as before.
+func (c *CMSketch) WithBloom(fpRate float64) *CMSketch {
+	if c.count > 0 && topNTotal(c.topN) == 0 {
+		return c
+	}
+	n := c.count
+	if n == 0 {
+		n = 1
+	}
+	c.bloom = newBloomFilter(n, fpRate)
+	for _, items := range c.topN {
+		for _, item := range items {
+			c.bloom.add(item.data)
+		}
+	}
+	return c
+}
+
 func (c *CMSketch) queryHashValue(h1, h2 uint64) uint64 {
 	vals := make([]uint32, c.depth)
 	min := uint32(math.MaxUint32)
@@ -288,13 +605,14 @@ func (c *CMSketch) queryHashValue(h1, h2 uint64) uint64 {
 }
 
 // MergeCMSketch merges two CM Sketch.
-// Call with CMSketch with Top-N initialized may downgrade the result
 func (c *CMSketch) MergeCMSketch(rc *CMSketch) error {
 	if c.depth != rc.depth || c.width != rc.width {
 		return errors.New("Dimensions of Count-Min Sketch should be the same")
 	}
-	if c.topN != nil || rc.topN != nil {
-		return errors.New("CMSketch with Top-N does not supports merge")
+	if c.topNInTable || rc.topNInTable {
+		// An online-built (InsertBytesTopN) sketch already counts its Top-N items in the table, so
+		// the demotion logic below, which assumes Top-N items are NOT in the table, would double them.
+		return errors.New("cannot merge a CMSketch built with InsertBytesTopN: its Top-N items are already counted in the table")
 	}
 	c.count += rc.count
 	for i := range c.table {
@@ -302,29 +620,101 @@ func (c *CMSketch) MergeCMSketch(rc *CMSketch) error {
 			c.table[i][j] += rc.table[i][j]
 		}
 	}
+	if c.topN == nil && rc.topN == nil {
+		return nil
+	}
+	numTop := topNTotal(c.topN)
+	if rNum := topNTotal(rc.topN); rNum > numTop {
+		numTop = rNum
+	}
+	merged := make(map[string]*dataCount, numTop*2)
+	mergeIn := func(items []*dataCount) {
+		for _, item := range items {
+			key := string(item.data)
+			if existing, ok := merged[key]; ok {
+				existing.count += item.count
+				continue
+			}
+			cpy := *item
+			cpy.heapIdx = -1
+			merged[key] = &cpy
+		}
+	}
+	for _, items := range c.topN {
+		mergeIn(items)
+	}
+	for _, items := range rc.topN {
+		mergeIn(items)
+	}
+	sorted := make([]*dataCount, 0, len(merged))
+	for _, item := range merged {
+		sorted = append(sorted, item)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].count > sorted[j].count
+	})
+	if uint32(len(sorted)) > numTop {
+		// Drop the old Top-N set before folding demoted items back into the CM table. Otherwise
+		// updateBytesWithDelta routes through updateTopNWithDelta first, finds the demoted item
+		// still present in c.topN (it hasn't been replaced with newTopN yet), and bumps its count
+		// there instead of landing in c.table, silently discarding it.
+		c.topN = nil
+		c.topNHeap = nil
+		for _, demoted := range sorted[numTop:] {
+			c.updateBytesWithDelta(demoted.data, demoted.count)
+		}
+		sorted = sorted[:numTop]
+	}
+	newTopN := make(map[uint64][]*dataCount, len(sorted))
+	newHeap := make(topNHeap, 0, len(sorted))
+	for _, item := range sorted {
+		item.heapIdx = -1
+		newTopN[item.h1] = append(newTopN[item.h1], item)
+		heap.Push(&newHeap, item)
+	}
+	c.topN = newTopN
+	c.numTop = numTop
+	c.topNHeap = newHeap
 	return nil
 }
 
+// topNTotal counts how many entries a Top-N set holds, accounting for h1 collisions.
+func topNTotal(topN map[uint64][]*dataCount) uint32 {
+	var n uint32
+	for _, items := range topN {
+		n += uint32(len(items))
+	}
+	return n
+}
+
 // CMSketchToProto converts CMSketch to its protobuf representation.
-// TODO: Encode/Decode cmsketch with Top-N
 func CMSketchToProto(c *CMSketch) *tipb.CMSketch {
-	protoSketch := &tipb.CMSketch{Rows: make([]*tipb.CMSketchRow, c.depth)}
+	protoSketch := &tipb.CMSketch{Rows: make([]*tipb.CMSketchRow, c.depth), DefaultValue: c.defaultValue}
 	for i := range c.table {
 		protoSketch.Rows[i] = &tipb.CMSketchRow{Counters: make([]uint32, c.width)}
 		for j := range c.table[i] {
 			protoSketch.Rows[i].Counters[j] = c.table[i][j]
 		}
 	}
+	for _, items := range c.topN {
+		for _, item := range items {
+			// tipb.CMSketchTopN only carries data/count; h1/h2 are recomputed from data on decode.
+			protoSketch.TopN = append(protoSketch.TopN, &tipb.CMSketchTopN{
+				Data:  item.data,
+				Count: item.count,
+			})
+		}
+	}
 	return protoSketch
 }
 
 // CMSketchFromProto converts CMSketch from its protobuf representation.
-// TODO: Encode/Decode cmsketch with Top-N
 func CMSketchFromProto(protoSketch *tipb.CMSketch) *CMSketch {
 	if protoSketch == nil {
 		return nil
 	}
 	c := NewCMSketch(int32(len(protoSketch.Rows)), int32(len(protoSketch.Rows[0].Counters)))
+	c.defaultValue = protoSketch.DefaultValue
 	for i, row := range protoSketch.Rows {
 		c.count = 0
 		for j, counter := range row.Counters {
@@ -332,32 +722,113 @@ func CMSketchFromProto(protoSketch *tipb.CMSketch) *CMSketch {
 			c.count = c.count + uint64(counter)
 		}
 	}
+	if len(protoSketch.TopN) == 0 {
+		return c
+	}
+	c.topN = make(map[uint64][]*dataCount, len(protoSketch.TopN))
+	c.topNHeap = make(topNHeap, 0, len(protoSketch.TopN))
+	for _, entry := range protoSketch.TopN {
+		// h1/h2 aren't carried over the wire; recompute them from data, same as every other insert path.
+		h1, h2 := murmur3.Sum128(entry.Data)
+		item := &dataCount{
+			h1:      h1,
+			h2:      h2,
+			data:    entry.Data,
+			count:   entry.Count,
+			heapIdx: -1,
+		}
+		c.topN[h1] = append(c.topN[h1], item)
+		heap.Push(&c.topNHeap, item)
+	}
+	c.numTop = uint32(len(protoSketch.TopN))
 	return c
 }
 
+// Flag bits packed into EncodeCMSketch's header byte. tipb.CMSketch has no field for either the Bloom
+// filter or topNInTable (only Rows, DefaultValue and TopN are real), so both travel in this header,
+// owned entirely by this function and DecodeCMSketch; neither reaches the coprocessor wire, since
+// CMSketchToProto/FromProto never see them.
+const (
+	cmSketchFlagBloom       = 1 << 0
+	cmSketchFlagTopNInTable = 1 << 1
+)
+
 // EncodeCMSketch encodes the given CMSketch to byte slice.
 func EncodeCMSketch(c *CMSketch) ([]byte, error) {
 	if c == nil || c.count == 0 {
 		return nil, nil
 	}
-	p := CMSketchToProto(c)
-	return p.Marshal()
+	body, err := CMSketchToProto(c).Marshal()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var flag byte
+	if c.bloom != nil {
+		flag |= cmSketchFlagBloom
+	}
+	if c.topNInTable {
+		flag |= cmSketchFlagTopNInTable
+	}
+	if c.bloom == nil {
+		return append([]byte{flag}, body...), nil
+	}
+	bloomBytes := c.bloom.marshal()
+	buf := make([]byte, 0, 5+len(bloomBytes)+len(body))
+	buf = append(buf, flag)
+	lenBuf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(lenBuf, uint32(len(bloomBytes)))
+	buf = append(buf, lenBuf...)
+	buf = append(buf, bloomBytes...)
+	buf = append(buf, body...)
+	return buf, nil
 }
 
-// DecodeCMSketch decode a CMSketch from the given byte slice.
+// legacyCMSketchTag is the first byte of a pre-series CMSketch blob: those were encoded as a bare
+// proto.Marshal() with no header at all, so their first byte is CMSketch's real wire tag for its Rows
+// field (field 1, length-delimited), which protobuf always emits as 0x0a since Rows is never empty.
+// EncodeCMSketch's own flag byte is always in 0..3 (see the cmSketchFlag* bits), which can never
+// collide with that, so DecodeCMSketch can tell the two formats apart without a version field of its
+// own. A legacy blob predates both the Bloom filter and topNInTable, so it decodes as flag 0.
+const legacyCMSketchTag = 0x0a
+
+// DecodeCMSketch decode a CMSketch from the given byte slice, the inverse of EncodeCMSketch. Blobs
+// persisted before EncodeCMSketch grew its header (a bare marshaled proto) still decode correctly: see
+// legacyCMSketchTag.
 func DecodeCMSketch(data []byte) (*CMSketch, error) {
-	if data == nil {
+	if len(data) == 0 {
 		return nil, nil
 	}
+	rest := data
+	var flag byte
+	var bloomBytes []byte
+	if data[0] != legacyCMSketchTag {
+		flag = data[0]
+		rest = data[1:]
+		if flag&cmSketchFlagBloom != 0 {
+			if len(rest) < 4 {
+				return nil, errors.New("corrupt CMSketch encoding: truncated bloom filter header")
+			}
+			bloomLen := binary.LittleEndian.Uint32(rest[:4])
+			rest = rest[4:]
+			if uint64(len(rest)) < uint64(bloomLen) {
+				return nil, errors.New("corrupt CMSketch encoding: truncated bloom filter body")
+			}
+			bloomBytes, rest = rest[:bloomLen], rest[bloomLen:]
+		}
+	}
 	p := &tipb.CMSketch{}
-	err := p.Unmarshal(data)
-	if err != nil {
+	if err := p.Unmarshal(rest); err != nil {
 		return nil, errors.Trace(err)
 	}
 	if len(p.Rows) == 0 {
 		return nil, nil
 	}
-	return CMSketchFromProto(p), nil
+	c := CMSketchFromProto(p)
+	c.topNInTable = flag&cmSketchFlagTopNInTable != 0
+	if bloomBytes != nil {
+		c.bloom = unmarshalBloomFilter(bloomBytes)
+	}
+	return c, nil
 }
 
 // TotalCount returns the count, it is only used for test.
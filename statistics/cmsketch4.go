@@ -0,0 +1,211 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statistics
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spaolacci/murmur3"
+)
+
+// cm4MaxCount is the saturation point of a 4-bit counter: once a cell reaches it, further inserts
+// are no-ops and QueryBytes should be read as "at least this many, possibly more".
+const cm4MaxCount = 15
+
+// CMSketch4 is a memory-compact sibling of CMSketch: it packs two 4-bit saturating counters per
+// byte (the CM4 layout used by Ristretto) instead of spending a uint32 per cell, trading precision
+// for roughly an 8x reduction in memory. It targets analyze-lite pipelines that keep many
+// per-partition sketches in memory at once, where the exact counts CMSketch offers aren't needed.
+type CMSketch4 struct {
+	depth        int32
+	width        int32 // number of 4-bit counters per row, not bytes
+	count        uint64
+	defaultValue uint64
+	rows         [][]byte // len(rows[i]) == (width+1)/2
+}
+
+// NewCMSketch4 returns a new CM4 sketch. width counts 4-bit counters per row; the backing row is
+// allocated at half that many bytes.
+func NewCMSketch4(d, w int32) *CMSketch4 {
+	rows := make([][]byte, d)
+	for i := range rows {
+		rows[i] = make([]byte, (w+1)/2)
+	}
+	return &CMSketch4{depth: d, width: w, rows: rows}
+}
+
+// cellIndex resolves which byte holds a row's counter for (h1, h2), and whether it lives in that
+// byte's low or high nibble.
+func (c *CMSketch4) cellIndex(h1, h2 uint64, row int) (byteIdx int, lowNibble bool) {
+	pos := (h1 + h2*uint64(row)) % uint64(c.width)
+	return int(pos / 2), pos%2 == 0
+}
+
+func getNibble(b byte, low bool) byte {
+	if low {
+		return b & 0x0f
+	}
+	return b >> 4
+}
+
+func setNibble(b byte, low bool, v byte) byte {
+	if low {
+		return (b &^ 0x0f) | (v & 0x0f)
+	}
+	return (b &^ 0xf0) | (v << 4)
+}
+
+// InsertBytes inserts the bytes value into the CM4 sketch, saturating each row's counter at 15.
+func (c *CMSketch4) InsertBytes(b []byte) {
+	h1, h2 := murmur3.Sum128(b)
+	c.count++
+	for i := range c.rows {
+		idx, low := c.cellIndex(h1, h2, i)
+		if cur := getNibble(c.rows[i][idx], low); cur < cm4MaxCount {
+			c.rows[i][idx] = setNibble(c.rows[i][idx], low, cur+1)
+		}
+	}
+}
+
+// QueryBytes returns the estimated count for b. A saturated row minimum (15) means the true count
+// could be arbitrarily higher, so callers should treat it as "saturated" and fall back to
+// defaultValue (or a Top-N lookup, for callers that keep one alongside the sketch) rather than
+// trusting it as exact.
+func (c *CMSketch4) QueryBytes(b []byte) uint64 {
+	h1, h2 := murmur3.Sum128(b)
+	min := byte(cm4MaxCount)
+	for i := range c.rows {
+		idx, low := c.cellIndex(h1, h2, i)
+		if v := getNibble(c.rows[i][idx], low); v < min {
+			min = v
+		}
+	}
+	if min == cm4MaxCount && c.defaultValue > 0 {
+		return c.defaultValue
+	}
+	return uint64(min)
+}
+
+// Reset halves every nibble in the sketch in place, the same conservative-decay aging CMSketch.Reset
+// applies at the uint32 granularity. Masking with 0x77 after the shift discards the bit that would
+// otherwise bleed from a byte's high nibble into its low nibble.
+func (c *CMSketch4) Reset() {
+	for i := range c.rows {
+		for j := range c.rows[i] {
+			c.rows[i][j] = (c.rows[i][j] >> 1) & 0x77
+		}
+	}
+	c.count >>= 1
+	c.defaultValue >>= 1
+}
+
+// CMSketch4ToProto converts a CMSketch4 to its protobuf representation. It reuses tipb.CMSketch's
+// Rows field, reporting each packed byte as a counter. tipb.CMSketch has no field to tag the layout
+// with, so telling a CM4 blob apart from a regular CMSketch one is EncodeCMSketch4/DecodeCMSketchAny's
+// job, via a leading tag byte outside the proto itself.
+func CMSketch4ToProto(c *CMSketch4) *tipb.CMSketch {
+	protoSketch := &tipb.CMSketch{
+		Rows:         make([]*tipb.CMSketchRow, c.depth),
+		DefaultValue: c.defaultValue,
+	}
+	for i := range c.rows {
+		counters := make([]uint32, len(c.rows[i]))
+		for j, b := range c.rows[i] {
+			counters[j] = uint32(b)
+		}
+		protoSketch.Rows[i] = &tipb.CMSketchRow{Counters: counters}
+	}
+	return protoSketch
+}
+
+// CMSketch4FromProto converts a CM4 protobuf representation back into a CMSketch4. Callers that
+// only have an opaque blob should go through DecodeCMSketchAny instead, which dispatches on the
+// leading cm4BlobTag byte.
+func CMSketch4FromProto(protoSketch *tipb.CMSketch) *CMSketch4 {
+	if protoSketch == nil || len(protoSketch.Rows) == 0 {
+		return nil
+	}
+	width := int32(len(protoSketch.Rows[0].Counters)) * 2
+	c := NewCMSketch4(int32(len(protoSketch.Rows)), width)
+	c.defaultValue = protoSketch.DefaultValue
+	for i, row := range protoSketch.Rows {
+		for j, counter := range row.Counters {
+			c.rows[i][j] = byte(counter)
+		}
+	}
+	return c
+}
+
+// cm4BlobTag prefixes the bytes EncodeCMSketch4 produces so DecodeCMSketchAny can tell a CM4 blob
+// apart from a plain EncodeCMSketch blob. tipb.CMSketch itself has no spare field to tag with (only
+// Rows, DefaultValue and TopN are real), so the tag lives outside the proto, in the blob this
+// package's own Encode/Decode functions own end to end; it never goes out over the coprocessor wire.
+const cm4BlobTag = 0xff
+
+// EncodeCMSketch4 encodes the given CM4 sketch to a byte slice.
+func EncodeCMSketch4(c *CMSketch4) ([]byte, error) {
+	if c == nil || c.count == 0 {
+		return nil, nil
+	}
+	body, err := CMSketch4ToProto(c).Marshal()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return append([]byte{cm4BlobTag}, body...), nil
+}
+
+// DecodeCMSketchAny decodes a byte slice produced by either EncodeCMSketch or EncodeCMSketch4,
+// dispatching on the leading tag byte EncodeCMSketch4 adds. At most one of the two returned sketches
+// is non-nil; both are nil for empty data, for a blob with no rows, and on error.
+func DecodeCMSketchAny(data []byte) (*CMSketch, *CMSketch4, error) {
+	if len(data) == 0 {
+		return nil, nil, nil
+	}
+	if data[0] == cm4BlobTag {
+		p := &tipb.CMSketch{}
+		if err := p.Unmarshal(data[1:]); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		if len(p.Rows) == 0 {
+			return nil, nil, nil
+		}
+		return nil, CMSketch4FromProto(p), nil
+	}
+	cms, err := DecodeCMSketch(data)
+	return cms, nil, err
+}
+
+// MergeInto folds c's saturating nibble counters into dst, a regular CMSketch, giving each row's
+// estimate as a floor — useful once a CM4 accumulator built during a memory-constrained phase needs
+// to hand its counts off to the full-precision sketch a caller keeps for the rest of a sketch's life.
+// A saturated (15) nibble is a lower bound only; dst's counter for that cell is raised by 15 same as
+// any other reading, since CMSketch counters have no saturation concept of their own to preserve.
+func (c *CMSketch4) MergeInto(dst *CMSketch) {
+	if c == nil || dst == nil {
+		return
+	}
+	for i := range c.rows {
+		if i >= len(dst.table) {
+			break
+		}
+		for pos := 0; pos < int(c.width) && pos < len(dst.table[i]); pos++ {
+			v := getNibble(c.rows[i][pos/2], pos%2 == 0)
+			if v == 0 {
+				continue
+			}
+			dst.table[i][pos] += uint32(v)
+		}
+	}
+	dst.count += c.count
+}